@@ -0,0 +1,533 @@
+// Package dockerfile parses a Dockerfile into a lightweight instruction AST.
+//
+// It understands line continuations, comments, parser directives
+// (# syntax=, # escape=), multi-stage builds, and ARG/ENV variable
+// expansion scoped per build stage. It intentionally does not validate
+// that the Dockerfile is buildable - callers that need richer semantics
+// (e.g. resolving COPY --from targets) should walk the returned AST
+// themselves.
+package dockerfile
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Instruction is a single parsed Dockerfile instruction, e.g. "EXPOSE 3000".
+type Instruction struct {
+	Cmd  string // upper-cased instruction name, e.g. "EXPOSE"
+	Args string // remainder of the line after the instruction, expanded
+	Line int    // 1-indexed source line the instruction started on
+}
+
+// Stage represents one `FROM ... [AS name]` build stage and everything
+// that happened inside it.
+type Stage struct {
+	Index        int
+	BaseImage    string // as written, e.g. "node:20-alpine" or another stage's name
+	Name         string // the "AS <name>" alias, if any
+	Instructions []Instruction
+
+	args map[string]string // ARG values in scope at each point, accumulated
+	env  map[string]string // ENV values in scope, accumulated
+}
+
+// AST is the parsed form of a Dockerfile.
+type AST struct {
+	SyntaxDirective string // value of "# syntax=" if present
+	EscapeChar      byte   // '\\' unless overridden by "# escape=`"
+	Stages          []*Stage
+}
+
+var exposeArgRe = regexp.MustCompile(`^(\d+)(/\w+)?$`)
+
+// Parse tokenizes Dockerfile content into an AST, resolving line
+// continuations and expanding ARG/ENV references as it goes.
+func Parse(content string) (*AST, error) {
+	ast := &AST{EscapeChar: '\\'}
+
+	lines := joinContinuations(content, ast)
+
+	var current *Stage
+	globalArgs := map[string]string{} // ARGs declared before the first FROM
+
+	for _, pl := range lines {
+		line := strings.TrimSpace(pl.text)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		cmd, rest := splitInstruction(line)
+		if cmd == "" {
+			continue
+		}
+
+		scope := globalArgs
+		if current != nil {
+			rest = expand(rest, current.env, current.args)
+		} else {
+			rest = expand(rest, nil, globalArgs)
+		}
+
+		switch cmd {
+		case "FROM":
+			base, alias := parseFrom(rest)
+			current = &Stage{
+				Index:     len(ast.Stages),
+				BaseImage: base,
+				Name:      alias,
+				args:      cloneMap(globalArgs),
+				env:       map[string]string{},
+			}
+			ast.Stages = append(ast.Stages, current)
+		case "ARG":
+			k, v := parseKV(rest)
+			if current != nil {
+				current.args[k] = v
+			} else {
+				scope[k] = v
+			}
+		case "ENV":
+			if current != nil {
+				for k, v := range parseEnv(rest) {
+					current.env[k] = v
+				}
+			}
+		}
+
+		if current != nil {
+			current.Instructions = append(current.Instructions, Instruction{
+				Cmd:  cmd,
+				Args: rest,
+				Line: pl.line,
+			})
+		}
+	}
+
+	if len(ast.Stages) == 0 {
+		return nil, fmt.Errorf("no FROM instruction found")
+	}
+
+	return ast, nil
+}
+
+// FinalStage returns the last build stage, i.e. the one that produces the
+// final image.
+func (a *AST) FinalStage() *Stage {
+	return a.Stages[len(a.Stages)-1]
+}
+
+// StageByName resolves a named stage (the target of `FROM <name> AS x` or
+// `COPY --from=<name>`), returning nil if no stage uses that alias.
+func (a *AST) StageByName(name string) *Stage {
+	for _, s := range a.Stages {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// ExposedPorts returns every port number named in EXPOSE instructions within
+// the stage, in the order they appear. A stage may expose more than one
+// port, and a single EXPOSE instruction may list several.
+func (s *Stage) ExposedPorts() []int {
+	var ports []int
+	for _, inst := range s.Instructions {
+		if inst.Cmd != "EXPOSE" {
+			continue
+		}
+		for _, field := range strings.Fields(inst.Args) {
+			m := exposeArgRe.FindStringSubmatch(field)
+			if m == nil {
+				continue
+			}
+			port, err := strconv.Atoi(m[1])
+			if err != nil || port < 1 || port > 65535 {
+				continue
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// User returns the most recently set USER instruction in the stage, or ""
+// if the stage never sets one (which means it runs as root).
+func (s *Stage) User() string {
+	user := ""
+	for _, inst := range s.Instructions {
+		if inst.Cmd == "USER" {
+			user = strings.TrimSpace(inst.Args)
+		}
+	}
+	return user
+}
+
+// HasHealthcheck reports whether the stage declares a HEALTHCHECK.
+func (s *Stage) HasHealthcheck() bool {
+	for _, inst := range s.Instructions {
+		if inst.Cmd == "HEALTHCHECK" {
+			return !strings.EqualFold(strings.TrimSpace(inst.Args), "NONE")
+		}
+	}
+	return false
+}
+
+// WorkDir returns the most recently set WORKDIR, or "" if unset.
+func (s *Stage) WorkDir() string {
+	dir := ""
+	for _, inst := range s.Instructions {
+		if inst.Cmd == "WORKDIR" {
+			dir = strings.TrimSpace(inst.Args)
+		}
+	}
+	return dir
+}
+
+// frameworkHints maps a base image prefix to a human-readable framework hint.
+var frameworkHints = []struct {
+	prefix string
+	hint   string
+}{
+	{"node:", "Node.js"},
+	{"python:", "Python"},
+	{"golang:", "Go"},
+	{"ruby:", "Ruby"},
+	{"php:", "PHP"},
+	{"nginx:", "Nginx (static/proxy)"},
+}
+
+// FrameworkHint guesses the application framework from the stage's base
+// image, e.g. "node:20-alpine" -> "Node.js". Returns "" if no known prefix
+// matches, which is common for scratch/distroless final stages.
+func (s *Stage) FrameworkHint() string {
+	image := s.BaseImage
+	if slash := strings.LastIndex(image, "/"); slash != -1 {
+		image = image[slash+1:]
+	}
+	for _, fh := range frameworkHints {
+		if strings.HasPrefix(image, fh.prefix) {
+			return fh.hint
+		}
+	}
+	return ""
+}
+
+type positionedLine struct {
+	text string
+	line int
+}
+
+// heredocRe matches a heredoc delimiter introduction, e.g. "<<EOF",
+// "<<-EOF", or "<<'EOF'". A RUN instruction may introduce more than one.
+var heredocRe = regexp.MustCompile(`<<-?\s*["']?([A-Za-z_][A-Za-z0-9_]*)["']?`)
+
+// joinContinuations merges backslash-continued lines into single logical
+// lines, strips the parser directives from the instruction stream (they're
+// recorded on the AST instead), and skips over heredoc bodies (`RUN <<EOF
+// ... EOF`) so their content - arbitrary script/file text, not Dockerfile
+// instructions - never gets fed back through splitInstruction.
+func joinContinuations(content string, ast *AST) []positionedLine {
+	rawLines := strings.Split(content, "\n")
+
+	var result []positionedLine
+	var buf strings.Builder
+	startLine := 0
+	directivesDone := false
+
+	flush := func() string {
+		s := buf.String()
+		if s != "" {
+			result = append(result, positionedLine{text: s, line: startLine})
+			buf.Reset()
+		}
+		return s
+	}
+
+	for i := 0; i < len(rawLines); i++ {
+		lineNo := i + 1
+		trimmed := strings.TrimRight(rawLines[i], "\r")
+
+		if !directivesDone {
+			t := strings.TrimSpace(trimmed)
+			if strings.HasPrefix(t, "#") {
+				if d, ok := parseDirective(t, "syntax"); ok {
+					ast.SyntaxDirective = d
+					continue
+				}
+				if d, ok := parseDirective(t, "escape"); ok {
+					if len(d) > 0 {
+						ast.EscapeChar = d[0]
+					}
+					continue
+				}
+				if t == "" {
+					continue
+				}
+				// A regular comment before the first instruction still ends
+				// the directive block per the Dockerfile frontend spec.
+			}
+			if t != "" {
+				directivesDone = true
+			}
+		}
+
+		if buf.Len() == 0 {
+			startLine = lineNo
+		}
+
+		escape := string(ast.EscapeChar)
+		if strings.HasSuffix(strings.TrimRight(trimmed, " \t"), escape) && !strings.HasPrefix(strings.TrimSpace(trimmed), "#") {
+			withoutEscape := strings.TrimRight(trimmed, " \t")
+			buf.WriteString(strings.TrimSuffix(withoutEscape, escape))
+			buf.WriteString(" ")
+			continue
+		}
+
+		buf.WriteString(trimmed)
+		logical := flush()
+		if logical != "" {
+			i = skipHeredocs(rawLines, i+1, logical) - 1
+		}
+	}
+	flush()
+
+	return result
+}
+
+// skipHeredocs advances past the body of every heredoc introduced on
+// logicalLine, in order, stopping after each one's terminator line. Returns
+// the index of the next line joinContinuations should resume parsing from.
+func skipHeredocs(rawLines []string, next int, logicalLine string) int {
+	for _, m := range heredocRe.FindAllStringSubmatch(logicalLine, -1) {
+		term := m[1]
+		for next < len(rawLines) && strings.TrimSpace(strings.TrimRight(rawLines[next], "\r")) != term {
+			next++
+		}
+		if next < len(rawLines) {
+			next++ // consume the terminator line itself
+		}
+	}
+	return next
+}
+
+func parseDirective(line, name string) (string, bool) {
+	body := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+	prefix := name + "="
+	if !strings.HasPrefix(strings.ToLower(body), prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(body[len(prefix):]), true
+}
+
+func splitInstruction(line string) (cmd, rest string) {
+	fields := strings.SplitN(line, " ", 2)
+	cmd = strings.ToUpper(fields[0])
+	if len(fields) == 2 {
+		rest = strings.TrimSpace(fields[1])
+	}
+	return cmd, rest
+}
+
+func parseFrom(rest string) (base, alias string) {
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	base = fields[0]
+	for i := 1; i < len(fields)-1; i++ {
+		if strings.EqualFold(fields[i], "AS") {
+			alias = fields[i+1]
+		}
+	}
+	return base, alias
+}
+
+func parseKV(rest string) (key, value string) {
+	parts := strings.SplitN(rest, "=", 2)
+	key = strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		value = strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+	}
+	return key, value
+}
+
+// parseEnv handles both "ENV KEY=VALUE" and the legacy "ENV KEY VALUE" form,
+// as well as multiple "KEY=VALUE KEY2=VALUE2" pairs on one line.
+func parseEnv(rest string) map[string]string {
+	out := map[string]string{}
+	if !strings.Contains(rest, "=") {
+		fields := strings.SplitN(rest, " ", 2)
+		if len(fields) == 2 {
+			out[fields[0]] = strings.Trim(strings.TrimSpace(fields[1]), `"'`)
+		}
+		return out
+	}
+	for _, field := range strings.Fields(rest) {
+		if !strings.Contains(field, "=") {
+			continue
+		}
+		k, v := parseKV(field)
+		out[k] = v
+	}
+	return out
+}
+
+var varRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// expand resolves ${VAR}/$VAR references against the accumulated ENV scope
+// (which wins, matching Docker's own precedence) falling back to ARG scope.
+func expand(s string, env, args map[string]string) string {
+	return varRe.ReplaceAllStringFunc(s, func(match string) string {
+		sub := varRe.FindStringSubmatch(match)
+		name := sub[1]
+		def := strings.TrimPrefix(sub[2], ":-")
+		if name == "" {
+			name = sub[3]
+		}
+		if env != nil {
+			if v, ok := env[name]; ok {
+				return v
+			}
+		}
+		if args != nil {
+			if v, ok := args[name]; ok {
+				return v
+			}
+		}
+		if def != "" {
+			return def
+		}
+		return match
+	})
+}
+
+var (
+	copyLineRe = regexp.MustCompile(`^(\s*)COPY\s+(.*)$`)
+	fromLineRe = regexp.MustCompile(`^(\s*)FROM\s+(\S+)((?:\s+[Aa][Ss]\s+\S+)?)\s*$`)
+)
+
+// RewriteNamedContexts rewrites Dockerfile instructions that reference a
+// named build context - `COPY --from=<name> ...` and `FROM <name> [AS
+// alias]` - whose <name> matches a key in contexts, so the Dockerfile can be
+// built without engine support for named contexts. It only rewrites text:
+// the caller must mount each referenced context directory into the existing
+// build context (".nexlayer/context-<name>", see ContextMountDir). Each
+// matching instruction is pointed at that mount directly:
+//
+//   - `COPY --from=<name> <src> <dest>` becomes a plain
+//     `COPY <mountDir>/<src> <dest>`, with any other COPY flags (--chown,
+//     --chmod, ...) preserved in their original order.
+//   - `FROM <name> [AS alias]` becomes `FROM scratch [AS alias]` followed by
+//     a `COPY <mountDir>/. ./` that copies the context's entire tree in,
+//     since a named context has no image to pull - its stage's filesystem
+//     root *is* the context directory.
+//
+// `--from=<stage>` and `FROM <stage>` references to an earlier build stage
+// are left untouched unless <stage> is also a key in contexts, in which case
+// the named context wins. It returns the rewritten content and the sorted list
+// of context names that were actually referenced.
+func RewriteNamedContexts(content string, contexts map[string]string) (rewritten string, used []string) {
+	if len(contexts) == 0 {
+		return content, nil
+	}
+
+	usedSet := map[string]bool{}
+	var out []string
+	for _, line := range strings.Split(content, "\n") {
+		if fromLines, name, ok := rewriteFromLine(line, contexts); ok {
+			out = append(out, fromLines...)
+			usedSet[name] = true
+			continue
+		}
+		if copyLine, name, ok := rewriteCopyLine(line, contexts); ok {
+			out = append(out, copyLine)
+			usedSet[name] = true
+			continue
+		}
+		out = append(out, line)
+	}
+
+	for name := range usedSet {
+		used = append(used, name)
+	}
+	sort.Strings(used)
+
+	return strings.Join(out, "\n"), used
+}
+
+// rewriteCopyLine rewrites a single `COPY [flags...] <src>... <dest>` line
+// if one of its flags is `--from=<name>` for a named context. Flags may
+// appear in any order (e.g. `--chown` before or after `--from`), unlike a
+// naive regex that assumes `--from=` is the first and only flag.
+func rewriteCopyLine(line string, contexts map[string]string) (rewrittenLine, name string, ok bool) {
+	m := copyLineRe.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", false
+	}
+	indent, rest := m[1], m[2]
+
+	tokens := strings.Fields(rest)
+	idx := 0
+	var flags []string
+	for idx < len(tokens) && strings.HasPrefix(tokens[idx], "--") {
+		flags = append(flags, tokens[idx])
+		idx++
+	}
+	positional := tokens[idx:]
+	if len(positional) == 0 {
+		return "", "", false
+	}
+
+	kept := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if v, cut := strings.CutPrefix(flag, "--from="); cut {
+			if _, isContext := contexts[v]; isContext {
+				name = v
+				continue // drop --from=<name>, it's replaced by the mounted path below
+			}
+		}
+		kept = append(kept, flag)
+	}
+	if name == "" {
+		return "", "", false
+	}
+
+	positional[0] = ContextMountDir(name) + "/" + positional[0]
+	return indent + "COPY " + strings.Join(append(kept, positional...), " "), name, true
+}
+
+// rewriteFromLine rewrites a `FROM <name> [AS alias]` line if <name> is a
+// named context, returning the (possibly multi-line) replacement.
+func rewriteFromLine(line string, contexts map[string]string) (lines []string, name string, ok bool) {
+	m := fromLineRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, "", false
+	}
+	indent, image, asClause := m[1], m[2], m[3]
+	if _, isContext := contexts[image]; !isContext {
+		return nil, "", false
+	}
+	return []string{
+		indent + "FROM scratch" + asClause,
+		indent + "COPY " + ContextMountDir(image) + "/. ./",
+	}, image, true
+}
+
+// ContextMountDir is the path, relative to the build context root, that
+// RewriteNamedContexts expects the named context "name" to be mounted at.
+func ContextMountDir(name string) string {
+	return ".nexlayer/context-" + name
+}
+
+func cloneMap(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,235 @@
+package dockerfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMultiStageArgEnvExpansion(t *testing.T) {
+	content := `
+ARG NODE_VERSION=20
+FROM node:${NODE_VERSION}-alpine AS build
+ARG BUILD_DIR=/app
+ENV HOME=${BUILD_DIR}
+WORKDIR ${HOME}
+RUN echo building
+
+FROM nginx:1.25 AS final
+ENV PORT=8080
+EXPOSE ${PORT}
+USER nginx
+`
+	ast, err := Parse(content)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(ast.Stages) != 2 {
+		t.Fatalf("got %d stages, want 2", len(ast.Stages))
+	}
+
+	build := ast.Stages[0]
+	if build.BaseImage != "node:20-alpine" {
+		t.Errorf("build.BaseImage = %q, want %q (ARG not expanded into FROM)", build.BaseImage, "node:20-alpine")
+	}
+	if build.Name != "build" {
+		t.Errorf("build.Name = %q, want %q", build.Name, "build")
+	}
+	if got := build.WorkDir(); got != "/app" {
+		t.Errorf("build.WorkDir() = %q, want %q (ENV not expanded from ARG)", got, "/app")
+	}
+
+	final := ast.FinalStage()
+	if final.Name != "final" {
+		t.Errorf("final.Name = %q, want %q", final.Name, "final")
+	}
+	if ports := final.ExposedPorts(); !reflect.DeepEqual(ports, []int{8080}) {
+		t.Errorf("final.ExposedPorts() = %v, want [8080] (ENV not expanded into EXPOSE)", ports)
+	}
+	if got := final.User(); got != "nginx" {
+		t.Errorf("final.User() = %q, want %q", got, "nginx")
+	}
+	if got := final.FrameworkHint(); got != "Nginx (static/proxy)" {
+		t.Errorf("final.FrameworkHint() = %q, want %q", got, "Nginx (static/proxy)")
+	}
+
+	if s := ast.StageByName("build"); s != build {
+		t.Errorf("StageByName(%q) = %v, want the build stage", "build", s)
+	}
+	if s := ast.StageByName("missing"); s != nil {
+		t.Errorf("StageByName(%q) = %v, want nil", "missing", s)
+	}
+}
+
+func TestStageExposedPorts(t *testing.T) {
+	tests := []struct {
+		name   string
+		expose string
+		want   []int
+	}{
+		{"single port", "EXPOSE 3000", []int{3000}},
+		{"with protocol", "EXPOSE 3000/tcp", []int{3000}},
+		{"multiple on one line", "EXPOSE 80 443/tcp 8080/udp", []int{80, 443, 8080}},
+		{"multiple instructions", "EXPOSE 80\nEXPOSE 443", []int{80, 443}},
+		{"out of range is skipped", "EXPOSE 70000", nil},
+		{"zero is skipped", "EXPOSE 0", nil},
+		{"non-numeric is skipped", "EXPOSE notaport", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "FROM scratch\n" + tt.expose + "\n"
+			ast, err := Parse(content)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			got := ast.FinalStage().ExposedPorts()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExposedPorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSkipsHeredocBodies(t *testing.T) {
+	content := `FROM node:20 AS build
+USER appuser
+RUN <<EOF
+cat > /etc/nginx/nginx.conf <<NGINX
+user www-data;
+NGINX
+EOF
+EXPOSE 3000
+`
+	ast, err := Parse(content)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	final := ast.FinalStage()
+
+	if got := final.User(); got != "appuser" {
+		t.Errorf("User() = %q, want %q (heredoc body line was parsed as an instruction)", got, "appuser")
+	}
+	if ports := final.ExposedPorts(); !reflect.DeepEqual(ports, []int{3000}) {
+		t.Errorf("ExposedPorts() = %v, want [3000]", ports)
+	}
+}
+
+func TestParseSkipsDashHeredocAndMultipleHeredocs(t *testing.T) {
+	content := `FROM alpine
+RUN <<-'ONE' <<TWO
+	EXPOSE 1337
+ONE
+USER evil
+TWO
+EXPOSE 9999
+`
+	ast, err := Parse(content)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	final := ast.FinalStage()
+
+	if got := final.User(); got != "" {
+		t.Errorf("User() = %q, want %q (heredoc body line was parsed as an instruction)", got, "")
+	}
+	if ports := final.ExposedPorts(); !reflect.DeepEqual(ports, []int{9999}) {
+		t.Errorf("ExposedPorts() = %v, want [9999] (heredoc-embedded EXPOSE leaked through)", ports)
+	}
+}
+
+func TestRewriteNamedContextsCopyFrom(t *testing.T) {
+	contexts := map[string]string{"shared": "/host/shared"}
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "bare copy from context",
+			line: "COPY --from=shared . /app/shared",
+			want: "COPY .nexlayer/context-shared/. /app/shared",
+		},
+		{
+			name: "flag after --from is preserved, not swallowed",
+			line: "COPY --from=shared --chown=user:group . /app/shared",
+			want: "COPY --chown=user:group .nexlayer/context-shared/. /app/shared",
+		},
+		{
+			name: "flag before --from is preserved",
+			line: "COPY --chown=user:group --from=shared . /app/shared",
+			want: "COPY --chown=user:group .nexlayer/context-shared/. /app/shared",
+		},
+		{
+			name: "stage reference is left untouched",
+			line: "COPY --from=build /app/dist /app/dist",
+			want: "COPY --from=build /app/dist /app/dist",
+		},
+		{
+			name: "indentation is preserved",
+			line: "    COPY --from=shared . /app/shared",
+			want: "    COPY .nexlayer/context-shared/. /app/shared",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, used := RewriteNamedContexts(tt.line+"\n", contexts)
+			want := tt.want + "\n"
+			if got != want {
+				t.Errorf("RewriteNamedContexts(%q) = %q, want %q", tt.line, got, want)
+			}
+			if tt.line != tt.want {
+				if !reflect.DeepEqual(used, []string{"shared"}) {
+					t.Errorf("used = %v, want [shared]", used)
+				}
+			} else if len(used) != 0 {
+				t.Errorf("used = %v, want none", used)
+			}
+		})
+	}
+}
+
+func TestRewriteNamedContextsFromAlias(t *testing.T) {
+	contexts := map[string]string{"shared": "/host/shared"}
+
+	content := "FROM node:18 AS build\n" +
+		"COPY --from=shared --chown=app:app . /app/shared\n" +
+		"FROM shared AS common\n" +
+		"COPY --from=common /x /y\n"
+
+	got, used := RewriteNamedContexts(content, contexts)
+
+	want := "FROM node:18 AS build\n" +
+		"COPY --chown=app:app .nexlayer/context-shared/. /app/shared\n" +
+		"FROM scratch AS common\n" +
+		"COPY .nexlayer/context-shared/. ./\n" +
+		"COPY --from=common /x /y\n"
+
+	if got != want {
+		t.Errorf("RewriteNamedContexts() =\n%s\nwant:\n%s", got, want)
+	}
+	if !reflect.DeepEqual(used, []string{"shared"}) {
+		t.Errorf("used = %v, want [shared]", used)
+	}
+}
+
+func TestRewriteNamedContextsNoop(t *testing.T) {
+	content := "FROM node:18\nCOPY . .\n"
+
+	got, used := RewriteNamedContexts(content, nil)
+	if got != content {
+		t.Errorf("RewriteNamedContexts with no contexts changed content:\n%s", got)
+	}
+	if used != nil {
+		t.Errorf("used = %v, want nil", used)
+	}
+
+	got, used = RewriteNamedContexts(content, map[string]string{"unused": "/host/unused"})
+	if got != content {
+		t.Errorf("RewriteNamedContexts with an unreferenced context changed content:\n%s", got)
+	}
+	if len(used) != 0 {
+		t.Errorf("used = %v, want none", used)
+	}
+}
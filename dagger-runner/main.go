@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 
 	"dagger.io/dagger"
 	"github.com/google/uuid"
+
+	"github.com/Nexlayer/nexlayer-mcp/dagger-runner/internal/dockerfile"
 )
 
 // BuildResult represents the output of the build process
@@ -21,21 +26,55 @@ type BuildResult struct {
 	Ports       map[string]int `json:"ports"`
 	Error       string         `json:"error,omitempty"`
 	DAGSummary  string         `json:"dagSummary,omitempty"`
-	LLMInsights string         `json:"llmInsights,omitempty"`
+	LLMInsights *LLMInsights   `json:"llmInsights,omitempty"`
+}
+
+// LLMInsights is the structured result of performLLMDAGAnalysis, parsed from
+// the provider's schema-constrained JSON reply.
+type LLMInsights struct {
+	Suggestions                []Suggestion  `json:"suggestions,omitempty"`
+	EstimatedImageSizeMB       int           `json:"estimatedImageSizeMB,omitempty"`
+	SecurityFindings           []string      `json:"securityFindings,omitempty"`
+	SuggestedDockerfilePatches []UnifiedDiff `json:"suggestedDockerfilePatches,omitempty"`
+}
+
+// Suggestion is one actionable build/pipeline recommendation from the LLM.
+type Suggestion struct {
+	Category string `json:"category"` // e.g. "security", "performance", "size"
+	Severity string `json:"severity"` // "low", "medium", "high"
+	Message  string `json:"message"`
+	Fix      string `json:"fix,omitempty"`
 }
 
+// UnifiedDiff is a unified-diff patch against a service's Dockerfile, e.g.
+// produced to add a non-root USER line. Downstream MCP tools can apply it
+// directly instead of just displaying it to the user.
+type UnifiedDiff string
+
 // ServiceConfig holds configuration for a service to be built
 type ServiceConfig struct {
 	Name             string
 	Path             string
 	Port             int
 	DockerfileExists bool
+	CacheFrom        []string
+	CacheTo          string
+	Platforms        []string
+	NamedContexts    map[string]string // context name -> absolute host path
+
+	// Populated from the Dockerfile's final stage when DockerfileExists.
+	BaseImage      string
+	Framework      string // e.g. "Node.js", "Python"; "" if unrecognized
+	User           string // "" means the image runs as root
+	HasHealthcheck bool
+	ExposedPorts   []int
+	Warnings       []string
 }
 
 func main() {
-	if len(os.Args) < 2 || len(os.Args) > 4 {
+	if len(os.Args) < 2 {
 		result := BuildResult{
-			Error: "Usage: nexlayer-dagger-runner <repo-path> [--llm-optimize] [--llm-provider=openai]",
+			Error: "Usage: nexlayer-dagger-runner <repo-path> [--llm-optimize] [--llm-provider=openai] [--cache-from=<image-ref>] [--cache-to=<image-ref>] [--platforms=linux/amd64,linux/arm64] [--context=<name>=<path>] [--registry=ghcr.io/org] [--tag-template='{{.Service}}-{{.Git.ShortSHA}}']",
 		}
 		outputResult(result)
 		os.Exit(1)
@@ -44,6 +83,12 @@ func main() {
 	repoPath := os.Args[1]
 	llmOptimize := false
 	llmProvider := "openai"
+	var cacheFrom []string
+	cacheTo := ""
+	platforms := []string{"linux/amd64"}
+	explicitContexts := map[string]string{}
+	registryName := ""
+	tagTemplate := ""
 
 	// Parse optional arguments
 	for i := 2; i < len(os.Args); i++ {
@@ -52,6 +97,21 @@ func main() {
 			llmOptimize = true
 		} else if strings.HasPrefix(arg, "--llm-provider=") {
 			llmProvider = strings.Split(arg, "=")[1]
+		} else if strings.HasPrefix(arg, "--cache-from=") {
+			cacheFrom = append(cacheFrom, strings.TrimPrefix(arg, "--cache-from="))
+		} else if strings.HasPrefix(arg, "--cache-to=") {
+			cacheTo = strings.TrimPrefix(arg, "--cache-to=")
+		} else if strings.HasPrefix(arg, "--platforms=") {
+			platforms = strings.Split(strings.TrimPrefix(arg, "--platforms="), ",")
+		} else if strings.HasPrefix(arg, "--context=") {
+			name, path, ok := strings.Cut(strings.TrimPrefix(arg, "--context="), "=")
+			if ok && name != "" {
+				explicitContexts[name] = path
+			}
+		} else if strings.HasPrefix(arg, "--registry=") {
+			registryName = strings.TrimPrefix(arg, "--registry=")
+		} else if strings.HasPrefix(arg, "--tag-template=") {
+			tagTemplate = strings.TrimPrefix(arg, "--tag-template=")
 		}
 	}
 
@@ -93,17 +153,39 @@ func main() {
 
 	log.Printf("📦 Found %d services to build", len(services))
 
+	// Auto-detect monorepo directories that sit alongside client/server
+	// (e.g. shared/, packages/) so Dockerfiles can reference them as
+	// named build contexts without hoisting the context to the repo root.
+	namedContexts := autoDetectNamedContexts(repoPath)
+	for name, path := range explicitContexts {
+		namedContexts[name] = resolveContextPath(repoPath, path)
+	}
+
+	// Thread registry cache references through to every service so
+	// buildWithDockerfile can warm its build from a prior published image
+	for i := range services {
+		services[i].CacheFrom = cacheFrom
+		services[i].CacheTo = cacheTo
+		services[i].Platforms = platforms
+		services[i].NamedContexts = namedContexts
+	}
+
 	// Generate DAG summary for LLM analysis
 	dagSummary := generateDAGSummary(services)
 
 	// LLM-aware DAG optimization (if enabled)
-	var llmInsights string
+	var llmInsights *LLMInsights
 	if llmOptimize {
-		llmInsights = performLLMDAGAnalysis(ctx, repoPath, services, llmProvider)
+		insights, err := performLLMDAGAnalysis(ctx, repoPath, services, llmProvider)
+		if err != nil {
+			log.Printf("⚠️  LLM analysis failed: %v", err)
+		} else {
+			llmInsights = insights
+		}
 	}
 
 	// Build and push images
-	result := buildAndPushImages(ctx, client, repoPath, services)
+	result := buildAndPushImages(ctx, client, repoPath, services, registryName, tagTemplate)
 	result.DAGSummary = dagSummary
 	result.LLMInsights = llmInsights
 
@@ -121,132 +203,133 @@ func analyzeRepository(repoPath string) []ServiceConfig {
 	// Check for client directory
 	clientPath := filepath.Join(repoPath, "client")
 	if stat, err := os.Stat(clientPath); err == nil && stat.IsDir() {
-		dockerfileExists := checkDockerfileExists(clientPath)
-		port := 3000 // Default React/frontend port
-
-		// Try to parse port from Dockerfile if it exists
-		if dockerfileExists {
-			if parsedPort, err := parseDockerfilePort(clientPath); err == nil {
-				port = parsedPort
-				log.Printf("📄 Extracted port %d from client Dockerfile", port)
-			} else {
-				log.Printf("⚠️  Could not parse port from client Dockerfile: %v, using default port %d", err, port)
-			}
-		}
-
-		services = append(services, ServiceConfig{
-			Name:             "client",
-			Path:             clientPath,
-			Port:             port,
-			DockerfileExists: dockerfileExists,
-		})
-		log.Printf("✅ Found client service at: %s (Dockerfile: %v, Port: %d)", clientPath, dockerfileExists, port)
+		services = append(services, buildServiceConfig("client", clientPath, 3000))
 	}
 
 	// Check for server directory
 	serverPath := filepath.Join(repoPath, "server")
 	if stat, err := os.Stat(serverPath); err == nil && stat.IsDir() {
-		dockerfileExists := checkDockerfileExists(serverPath)
-		port := 5000 // Default backend port
-
-		// Try to parse port from Dockerfile if it exists
-		if dockerfileExists {
-			if parsedPort, err := parseDockerfilePort(serverPath); err == nil {
-				port = parsedPort
-				log.Printf("📄 Extracted port %d from server Dockerfile", port)
-			} else {
-				log.Printf("⚠️  Could not parse port from server Dockerfile: %v, using default port %d", err, port)
-			}
-		}
-
-		services = append(services, ServiceConfig{
-			Name:             "server",
-			Path:             serverPath,
-			Port:             port,
-			DockerfileExists: dockerfileExists,
-		})
-		log.Printf("✅ Found server service at: %s (Dockerfile: %v, Port: %d)", serverPath, dockerfileExists, port)
+		services = append(services, buildServiceConfig("server", serverPath, 5000))
 	}
 
 	// Check for root-level service (fallback)
-	if len(services) == 0 {
-		if hasNodeProject(repoPath) {
-			dockerfileExists := checkDockerfileExists(repoPath)
-			port := 3000 // Default port
-
-			// Try to parse port from Dockerfile if it exists
-			if dockerfileExists {
-				if parsedPort, err := parseDockerfilePort(repoPath); err == nil {
-					port = parsedPort
-					log.Printf("📄 Extracted port %d from root Dockerfile", port)
-				} else {
-					log.Printf("⚠️  Could not parse port from root Dockerfile: %v, using default port %d", err, port)
-				}
-			}
+	if len(services) == 0 && hasNodeProject(repoPath) {
+		services = append(services, buildServiceConfig("app", repoPath, 3000))
+	}
 
-			services = append(services, ServiceConfig{
-				Name:             "app",
-				Path:             repoPath,
-				Port:             port,
-				DockerfileExists: dockerfileExists,
-			})
-			if dockerfileExists {
-				log.Printf("✅ Found root-level project with MCP-generated Dockerfile (Port: %d)", port)
-			} else {
-				log.Printf("⚠️  Found root-level project but no Dockerfile - needs nexlayer_generate_dockerfile")
-			}
+	return services
+}
+
+// ignoredContextDirs are top-level directories that are never useful as a
+// named build context (tooling/VCS metadata, not shared application code).
+var ignoredContextDirs = map[string]bool{
+	"client":       true,
+	"server":       true,
+	".git":         true,
+	".github":      true,
+	"node_modules": true,
+	"dist":         true,
+	"build":        true,
+	"vendor":       true,
+	".vscode":      true,
+	".idea":        true,
+}
+
+// autoDetectNamedContexts finds top-level directories besides client/server
+// that a monorepo's Dockerfiles might want to COPY from (e.g. shared/,
+// packages/), keyed by directory name. Only the repo's top level is read:
+// a nested directory such as packages/common is not a context of its own.
+func autoDetectNamedContexts(repoPath string) map[string]string {
+	contexts := map[string]string{}
+
+	entries, err := os.ReadDir(repoPath)
+	if err != nil {
+		return contexts
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || ignoredContextDirs[entry.Name()] || strings.HasPrefix(entry.Name(), ".") {
+			continue
 		}
+		contexts[entry.Name()] = filepath.Join(repoPath, entry.Name())
 	}
 
-	return services
+	return contexts
 }
 
-// checkDockerfileExists checks if a Dockerfile exists in the given directory
-func checkDockerfileExists(dir string) bool {
-	dockerfilePath := filepath.Join(dir, "Dockerfile")
-	_, err := os.Stat(dockerfilePath)
-	return err == nil
+// resolveContextPath resolves a --context path against repoPath unless it's
+// already absolute.
+func resolveContextPath(repoPath, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(repoPath, path)
+}
+
+// buildServiceConfig inspects a single service directory, parsing its
+// Dockerfile (if any) with the internal/dockerfile analyzer to recover the
+// final stage's base image, exposed ports, and USER/HEALTHCHECK posture.
+func buildServiceConfig(name, path string, defaultPort int) ServiceConfig {
+	dockerfileExists := checkDockerfileExists(path)
+	service := ServiceConfig{
+		Name:             name,
+		Path:             path,
+		Port:             defaultPort,
+		DockerfileExists: dockerfileExists,
+	}
+
+	if !dockerfileExists {
+		log.Printf("⚠️  Found %s service at: %s but no Dockerfile - needs nexlayer_generate_dockerfile", name, path)
+		return service
+	}
+
+	ast, err := analyzeDockerfile(path)
+	if err != nil {
+		log.Printf("⚠️  Could not parse Dockerfile for %s: %v, using default port %d", name, err, defaultPort)
+		log.Printf("✅ Found %s service at: %s (Dockerfile: true, Port: %d)", name, path, service.Port)
+		return service
+	}
+
+	final := ast.FinalStage()
+	service.BaseImage = final.BaseImage
+	service.Framework = final.FrameworkHint()
+	service.User = final.User()
+	service.HasHealthcheck = final.HasHealthcheck()
+	service.ExposedPorts = final.ExposedPorts()
+
+	if len(service.ExposedPorts) > 0 {
+		service.Port = service.ExposedPorts[0]
+		log.Printf("📄 Extracted port %d from %s Dockerfile (base: %s)", service.Port, name, service.BaseImage)
+	} else {
+		log.Printf("⚠️  No EXPOSE found in %s Dockerfile, using default port %d", name, defaultPort)
+	}
+
+	if service.User == "" {
+		service.Warnings = append(service.Warnings, "container runs as root (no USER instruction)")
+	}
+	if !service.HasHealthcheck {
+		service.Warnings = append(service.Warnings, "no HEALTHCHECK instruction")
+	}
+
+	log.Printf("✅ Found %s service at: %s (Dockerfile: true, Port: %d)", name, path, service.Port)
+	return service
 }
 
-// parseDockerfilePort extracts the exposed port from a Dockerfile
-func parseDockerfilePort(dir string) (int, error) {
+// analyzeDockerfile reads and parses the Dockerfile in dir into an AST.
+func analyzeDockerfile(dir string) (*dockerfile.AST, error) {
 	dockerfilePath := filepath.Join(dir, "Dockerfile")
 	content, err := os.ReadFile(dockerfilePath)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read Dockerfile: %v", err)
-	}
-
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		// Trim whitespace and convert to uppercase for case-insensitive matching
-		trimmedLine := strings.TrimSpace(strings.ToUpper(line))
-
-		// Look for EXPOSE directive
-		if strings.HasPrefix(trimmedLine, "EXPOSE") {
-			// Extract port number from EXPOSE directive
-			parts := strings.Fields(trimmedLine)
-			if len(parts) >= 2 {
-				portStr := parts[1]
-				// Handle cases like "EXPOSE 3000" or "EXPOSE 3000/tcp"
-				if strings.Contains(portStr, "/") {
-					portStr = strings.Split(portStr, "/")[0]
-				}
-
-				port, err := strconv.Atoi(portStr)
-				if err != nil {
-					return 0, fmt.Errorf("invalid port number in EXPOSE directive: %s", portStr)
-				}
-
-				if port < 1 || port > 65535 {
-					return 0, fmt.Errorf("port number out of range: %d", port)
-				}
-
-				return port, nil
-			}
-		}
+		return nil, fmt.Errorf("failed to read Dockerfile: %v", err)
 	}
+	return dockerfile.Parse(string(content))
+}
 
-	return 0, fmt.Errorf("no EXPOSE directive found in Dockerfile")
+// checkDockerfileExists checks if a Dockerfile exists in the given directory
+func checkDockerfileExists(dir string) bool {
+	dockerfilePath := filepath.Join(dir, "Dockerfile")
+	_, err := os.Stat(dockerfilePath)
+	return err == nil
 }
 
 // hasNodeProject checks if a directory contains a Node.js project
@@ -257,25 +340,26 @@ func hasNodeProject(dir string) bool {
 }
 
 // buildAndPushImages builds and pushes container images for all services
-func buildAndPushImages(ctx context.Context, client *dagger.Client, repoPath string, services []ServiceConfig) BuildResult {
+func buildAndPushImages(ctx context.Context, client *dagger.Client, repoPath string, services []ServiceConfig, registryName, tagTemplate string) BuildResult {
 	result := BuildResult{
 		Ports: make(map[string]int),
 	}
 
 	// Generate unique identifier for this build
 	buildID := strings.ToLower(uuid.New().String()[:8])
+	registry := newRegistry(registryName, tagTemplate, buildID, gitShortSHA(repoPath))
 
 	for _, service := range services {
 		log.Printf("🔨 Building %s service...", service.Name)
 
-		// Set up the container
-		var container *dagger.Container
+		// Build one container per requested platform
+		var variants []*dagger.Container
 		var err error
 
 		if service.DockerfileExists {
 			// Use existing Dockerfile (generated by MCP)
 			log.Printf("📄 Using Dockerfile for %s (generated by MCP)", service.Name)
-			container, err = buildWithDockerfile(ctx, client, service.Path)
+			variants, err = buildWithDockerfile(ctx, client, service.Path, service.CacheFrom, service.CacheTo, service.Platforms, service.NamedContexts)
 		} else {
 			// Dockerfile should be generated by MCP first
 			log.Printf("❌ No Dockerfile found for %s - MCP should generate Dockerfile first", service.Name)
@@ -288,12 +372,33 @@ func buildAndPushImages(ctx context.Context, client *dagger.Client, repoPath str
 			return result
 		}
 
-		// Generate image URL for ttl.sh
-		imageURL := fmt.Sprintf("ttl.sh/%s-%s:1h", service.Name, buildID)
-		log.Printf("📤 Pushing %s to %s", service.Name, imageURL)
+		// Resolve where this image is pushed and authenticate every platform
+		// variant if the registry needs it (ttl.sh accepts anonymous pushes;
+		// ECR gets a token from the AWS CLI; every other registry resolves
+		// credentials from env vars, ~/.docker/config.json, or a
+		// docker-credential-* helper).
+		imageURL := registry.ImageRef(service.Name)
+		for i, variant := range variants {
+			authed, err := registry.Authenticate(ctx, client, variant)
+			if err != nil {
+				result.Error = fmt.Sprintf("Failed to authenticate with registry for %s: %v", service.Name, err)
+				return result
+			}
+			variants[i] = authed
+		}
 
-		// Push to registry
-		publishedURL, err := container.Publish(ctx, imageURL)
+		log.Printf("📤 Pushing %s to %s (%d platform(s))", service.Name, imageURL, len(variants))
+
+		// Publish a single pullable reference. When more than one platform was
+		// built, Dagger assembles the variants into one multi-arch manifest list
+		// so `BuildResult.Client`/`Server` always stay a single reference. Publish
+		// from a bare container rather than variants[0] itself, since that
+		// variant is already listed in PlatformVariants and Dagger's documented
+		// multi-platform pattern doesn't double up the receiver as one of its
+		// own variants.
+		publishedURL, err := client.Container().Publish(ctx, imageURL, dagger.ContainerPublishOpts{
+			PlatformVariants: variants,
+		})
 		if err != nil {
 			result.Error = fmt.Sprintf("Failed to push %s: %v", service.Name, err)
 			return result
@@ -319,17 +424,75 @@ func buildAndPushImages(ctx context.Context, client *dagger.Client, repoPath str
 	return result
 }
 
-// buildWithDockerfile builds using an existing Dockerfile
-func buildWithDockerfile(ctx context.Context, client *dagger.Client, servicePath string) (*dagger.Container, error) {
+// buildWithDockerfile builds using an existing Dockerfile, once per requested
+// platform, and returns the resulting per-platform containers in order.
+func buildWithDockerfile(ctx context.Context, client *dagger.Client, servicePath string, cacheFrom []string, cacheTo string, platforms []string, namedContexts map[string]string) ([]*dagger.Container, error) {
 	// Mount the service directory
 	sourceDir := client.Host().Directory(servicePath)
+	dockerfileName := "Dockerfile"
+
+	// Resolve any `COPY --from=<name>` referencing a named build context
+	// (e.g. a sibling shared/ directory) by mounting that directory into
+	// the build context and pointing the instruction at it directly, since
+	// Dagger's Build() only accepts a single context directory.
+	if raw, err := os.ReadFile(filepath.Join(servicePath, dockerfileName)); err == nil {
+		rewritten, used := dockerfile.RewriteNamedContexts(string(raw), namedContexts)
+		if len(used) > 0 {
+			dockerfileName = "Dockerfile.nexlayer-contexts"
+			sourceDir = sourceDir.WithNewFile(dockerfileName, rewritten)
+			for _, name := range used {
+				log.Printf("📦 Mounting named context %q from %s", name, namedContexts[name])
+				sourceDir = sourceDir.WithDirectory(dockerfile.ContextMountDir(name), client.Host().Directory(namedContexts[name]))
+			}
+		}
+	}
+
+	// Best-effort cache warm from prior published images. This is NOT a real
+	// cache-from: Dagger's Go SDK has no registry cache-import primitive, so
+	// there's no way to hand the builder an inline-cache manifest the way
+	// `docker build --cache-from type=registry` does. Pulling each reference
+	// into the engine only helps when a later layer happens to share the same
+	// content-addressed digest as something already built in this engine
+	// session - it will not warm a fresh CI runner's cache from a cold start,
+	// which is the main case --cache-from was asked for. Kept because it's
+	// free and occasionally helps, but callers should not expect it to
+	// meaningfully shorten cold builds.
+	for _, ref := range cacheFrom {
+		log.Printf("🗄️  Best-effort cache warm from %s (no guaranteed hit - see comment above)", ref)
+		if _, err := client.Container().From(ref).Sync(ctx); err != nil {
+			log.Printf("⚠️  Could not warm cache from %s: %v", ref, err)
+		}
+	}
 
-	// Build using the existing Dockerfile with linux/amd64 platform
-	container := client.Container(dagger.ContainerOpts{
-		Platform: dagger.Platform("linux/amd64"), // Force linux/amd64 for Nexlayer compatibility
-	}).Build(sourceDir)
+	if len(platforms) == 0 {
+		platforms = []string{"linux/amd64"}
+	}
+
+	variants := make([]*dagger.Container, 0, len(platforms))
+	for _, platform := range platforms {
+		log.Printf("🔨 Building for platform %s", platform)
+		container := client.Container(dagger.ContainerOpts{
+			Platform: dagger.Platform(platform),
+		}).Build(sourceDir, dagger.ContainerBuildOpts{
+			Dockerfile: dockerfileName,
+		})
+		variants = append(variants, container)
+	}
 
-	return container, nil
+	if cacheTo != "" {
+		// Not a real inline-cache manifest (see the --cache-from comment
+		// above) - this just republishes the image itself under cacheTo so a
+		// later --cache-from=cacheTo has something to pull and dedup
+		// against. It carries no separate cache metadata.
+		log.Printf("🗄️  Publishing build output to %s for later --cache-from use (not a true cache manifest)", cacheTo)
+		if _, err := client.Container().Publish(ctx, cacheTo, dagger.ContainerPublishOpts{
+			PlatformVariants: variants,
+		}); err != nil {
+			log.Printf("⚠️  Could not publish to %s: %v", cacheTo, err)
+		}
+	}
+
+	return variants, nil
 }
 
 // outputResult outputs the final result as JSON to stdout
@@ -349,10 +512,21 @@ func generateDAGSummary(services []ServiceConfig) string {
 	summary := fmt.Sprintf("Build DAG for %d service(s):\n", len(services))
 
 	for _, service := range services {
+		framework := service.Framework
+		if framework == "" {
+			framework = "unknown base image"
+		}
 		if service.DockerfileExists {
-			summary += fmt.Sprintf("- %s: Node.js service (port %d) [Dockerfile with EXPOSE %d]\n", service.Name, service.Port, service.Port)
+			exposeNote := fmt.Sprintf("Dockerfile with EXPOSE %d", service.Port)
+			if len(service.ExposedPorts) == 0 {
+				exposeNote = "Dockerfile without EXPOSE, default port"
+			}
+			summary += fmt.Sprintf("- %s: %s service (port %d, base %s) [%s]\n", service.Name, framework, service.Port, service.BaseImage, exposeNote)
+			for _, warning := range service.Warnings {
+				summary += fmt.Sprintf("  ⚠ %s\n", warning)
+			}
 		} else {
-			summary += fmt.Sprintf("- %s: Node.js service (port %d) [Auto-generated Dockerfile]\n", service.Name, service.Port)
+			summary += fmt.Sprintf("- %s: service (port %d) [Auto-generated Dockerfile]\n", service.Name, service.Port)
 		}
 	}
 
@@ -367,103 +541,208 @@ func generateDAGSummary(services []ServiceConfig) string {
 	return summary
 }
 
-// Perform LLM DAG analysis and optimization
-func performLLMDAGAnalysis(ctx context.Context, repoPath string, services []ServiceConfig, provider string) string {
-	log.Printf("🤖 Starting LLM DAG analysis...")
+// llmHTTPClient is shared by both providers; LLM calls are a handful of
+// round trips per build, not a hot path, so a generous fixed timeout is fine.
+var llmHTTPClient = &http.Client{Timeout: 60 * time.Second}
+
+// llmSystemPrompt pins the model to LLMInsights' exact shape so the runner
+// can unmarshal the reply without a free-form parsing step.
+const llmSystemPrompt = `You are an expert DevOps engineer analyzing a Dagger build pipeline for Nexlayer.
+Reply with ONLY a single JSON object (no markdown fences, no commentary) matching this shape:
+{
+  "suggestions": [{"category": "security|performance|size", "severity": "low|medium|high", "message": "...", "fix": "..."}],
+  "estimatedImageSizeMB": 0,
+  "securityFindings": ["..."],
+  "suggestedDockerfilePatches": ["--- a/Dockerfile\n+++ b/Dockerfile\n@@ ...\n"]
+}
+Omit fields you have no finding for rather than inventing one.`
+
+// performLLMDAGAnalysis sends the build's Dockerfiles and service layout to
+// the configured LLM provider and returns its structured suggestions.
+func performLLMDAGAnalysis(ctx context.Context, repoPath string, services []ServiceConfig, provider string) (*LLMInsights, error) {
+	log.Printf("🤖 Starting LLM DAG analysis (%s)...", provider)
 
-	// Construct prompt for LLM
 	prompt := buildLLMPrompt(repoPath, services)
 
-	// Call LLM API (mock implementation - replace with actual LLM integration)
-	response := mockLLMCall(prompt, provider)
+	var raw string
+	var err error
+	switch provider {
+	case "anthropic":
+		raw, err = callAnthropic(ctx, prompt)
+	case "openai":
+		raw, err = callOpenAI(ctx, prompt)
+	default:
+		return nil, fmt.Errorf("unsupported LLM provider: %s", provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var insights LLMInsights
+	if err := json.Unmarshal([]byte(raw), &insights); err != nil {
+		return nil, fmt.Errorf("failed to parse %s response as LLMInsights JSON: %w", provider, err)
+	}
 
-	log.Printf("🤖 LLM analysis completed")
-	return response
+	log.Printf("🤖 LLM analysis completed: %d suggestion(s)", len(insights.Suggestions))
+	return &insights, nil
 }
 
-// Build comprehensive prompt for LLM analysis
+// buildLLMPrompt describes the real build pipeline - including each
+// service's actual Dockerfile contents - so the model reasons about what
+// will actually be built rather than a generic placeholder.
 func buildLLMPrompt(repoPath string, services []ServiceConfig) string {
-	prompt := "You are an expert DevOps engineer analyzing a Dagger build pipeline. "
-	prompt += "Based on the repository structure, suggest optimizations for the build process.\n\n"
-
-	prompt += fmt.Sprintf("Repository: %s\n", repoPath)
+	prompt := fmt.Sprintf("Repository: %s\n", repoPath)
 	prompt += fmt.Sprintf("Services found: %d\n\n", len(services))
 
 	for _, service := range services {
-		prompt += fmt.Sprintf("Service: %s\n", service.Name)
-		prompt += fmt.Sprintf("- Type: Node.js application\n")
+		prompt += fmt.Sprintf("## Service: %s\n", service.Name)
+		if service.Framework != "" {
+			prompt += fmt.Sprintf("- Type: %s application (base image %s)\n", service.Framework, service.BaseImage)
+		} else if service.BaseImage != "" {
+			prompt += fmt.Sprintf("- Base image: %s\n", service.BaseImage)
+		}
 		prompt += fmt.Sprintf("- Port: %d\n", service.Port)
 		prompt += fmt.Sprintf("- Custom Dockerfile: %v\n", service.DockerfileExists)
+		for _, warning := range service.Warnings {
+			prompt += fmt.Sprintf("- Warning: %s\n", warning)
+		}
+
+		if service.DockerfileExists {
+			if content, err := os.ReadFile(filepath.Join(service.Path, "Dockerfile")); err == nil {
+				prompt += fmt.Sprintf("- Dockerfile:\n```\n%s\n```\n", string(content))
+			}
+		}
 		prompt += "\n"
 	}
 
 	prompt += "Current build workflow:\n"
 	prompt += "1. MCP generates optimized Dockerfile via nexlayer_generate_dockerfile\n"
-	prompt += "2. Dagger builds from MCP-generated Dockerfile (linux/amd64)\n"
-	prompt += "3. Push built image to ttl.sh registry\n"
+	prompt += "2. Dagger builds from MCP-generated Dockerfile\n"
+	prompt += "3. Push built image to a registry (ttl.sh by default)\n"
 	prompt += "4. Return image URLs for nexlayer.yaml generation\n\n"
 
-	prompt += "Please suggest optimizations for:\n"
-	prompt += "1. MCP Dockerfile generation improvements\n"
-	prompt += "2. Dagger build process enhancements\n"
-	prompt += "3. ttl.sh registry optimization\n"
-	prompt += "4. Nexlayer platform compatibility\n"
-	prompt += "5. Build performance and security\n\n"
-
-	prompt += "Focus on optimizations that work within the MCP → Dagger → Nexlayer workflow."
+	prompt += "Review the Dockerfiles above and suggest optimizations for build performance, " +
+		"final image size, and security (e.g. missing non-root USER, missing HEALTHCHECK). " +
+		"Where a fix is a small Dockerfile change, include it as a unified diff in suggestedDockerfilePatches."
 
 	return prompt
 }
 
-// Mock LLM call (replace with actual LLM integration)
-func mockLLMCall(prompt string, provider string) string {
-	log.Printf("🤖 Calling %s LLM API...", provider)
-
-	// This is a mock response - in production, this would call OpenAI, Anthropic, etc.
-	// Example of how to integrate:
-	// if provider == "openai" {
-	//     return callOpenAI(prompt)
-	// } else if provider == "anthropic" {
-	//     return callAnthropic(prompt)
-	// }
-
-	// Mock intelligent response based on new MCP → Dagger → Nexlayer workflow
-	insights := "🧠 LLM Analysis Results:\n\n"
-	insights += "1. **Workflow**: ✅ Using MCP-generated Dockerfiles (no local image building)\n"
-	insights += "2. **Platform**: ✅ Enforcing linux/amd64 for Nexlayer compatibility\n"
-	insights += "3. **Registry**: ✅ Using ttl.sh for temporary image hosting\n"
-	insights += "4. **MCP Integration**: Consider caching Dockerfile generations for similar projects\n"
-	insights += "5. **Build Optimization**: Multi-stage Dockerfiles reduce final image size\n"
-	insights += "6. **Security**: MCP-generated Dockerfiles should include non-root users\n"
-	insights += "7. **YAML Patching**: Image URLs properly integrated into nexlayer.yaml pods\n\n"
-	insights += "💡 This workflow ensures consistent, optimized builds that work seamlessly with Nexlayer"
-
-	return insights
-}
-
-// Optional: Real LLM integration examples (commented out for reference)
-/*
-func callOpenAI(prompt string) string {
-	// Example OpenAI integration
+// callOpenAI sends prompt to the Chat Completions API and returns the raw
+// JSON text of the model's reply (expected to match LLMInsights).
+func callOpenAI(ctx context.Context, prompt string) (string, error) {
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
-		return "OpenAI API key not configured"
+		return "", fmt.Errorf("OPENAI_API_KEY not set")
 	}
 
-	// Make API call to OpenAI
-	// ... implementation
-	return "OpenAI response"
+	reqBody, err := json.Marshal(map[string]any{
+		"model": "gpt-4o-mini",
+		"messages": []map[string]string{
+			{"role": "system", "content": llmSystemPrompt},
+			{"role": "user", "content": prompt},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+		"temperature":     0.2,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal OpenAI request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.openai.com/v1/chat/completions", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("failed to build OpenAI request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := llmHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OpenAI request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read OpenAI response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OpenAI returned %d: %s", resp.StatusCode, body)
+	}
+
+	var parsed struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("failed to parse OpenAI envelope: %w", err)
+	}
+	if len(parsed.Choices) == 0 {
+		return "", fmt.Errorf("OpenAI response had no choices")
+	}
+
+	return parsed.Choices[0].Message.Content, nil
 }
 
-func callAnthropic(prompt string) string {
-	// Example Anthropic integration
+// callAnthropic sends prompt to the Messages API and returns the raw JSON
+// text of the model's reply (expected to match LLMInsights).
+func callAnthropic(ctx context.Context, prompt string) (string, error) {
 	apiKey := os.Getenv("ANTHROPIC_API_KEY")
 	if apiKey == "" {
-		return "Anthropic API key not configured"
+		return "", fmt.Errorf("ANTHROPIC_API_KEY not set")
+	}
+
+	reqBody, err := json.Marshal(map[string]any{
+		"model":      "claude-3-5-sonnet-20241022",
+		"max_tokens": 2048,
+		"system":     llmSystemPrompt,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal Anthropic request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.anthropic.com/v1/messages", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("failed to build Anthropic request: %w", err)
+	}
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := llmHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Anthropic request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Anthropic response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Anthropic returned %d: %s", resp.StatusCode, body)
+	}
+
+	var parsed struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("failed to parse Anthropic envelope: %w", err)
+	}
+	for _, block := range parsed.Content {
+		if block.Type == "text" {
+			return block.Text, nil
+		}
 	}
 
-	// Make API call to Anthropic
-	// ... implementation
-	return "Anthropic response"
+	return "", fmt.Errorf("Anthropic response had no text content block")
 }
-*/
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"dagger.io/dagger"
+)
+
+// Registry selects where built images are pushed and how they authenticate.
+// ttl.sh (the long-standing default) accepts anonymous pushes; everything
+// else needs credentials resolved before Publish is called.
+type Registry interface {
+	// ImageRef returns the full pullable reference a built image for
+	// serviceName should be published to.
+	ImageRef(serviceName string) string
+	// Authenticate returns container with any registry credentials it needs
+	// attached, via WithRegistryAuth.
+	Authenticate(ctx context.Context, client *dagger.Client, container *dagger.Container) (*dagger.Container, error)
+}
+
+// newRegistry constructs the Registry named by --registry, e.g. "" (ttl.sh),
+// "myuser" or "docker.io/myuser" (Docker Hub), "ghcr.io/myorg" (GHCR),
+// "<account>.dkr.ecr.<region>.amazonaws.com/<repo>" (ECR), or any other
+// "host/namespace" (generic OCI registry).
+func newRegistry(name, tagTemplate, buildID, gitSHA string) Registry {
+	switch {
+	case name == "" || name == "ttl.sh":
+		return &ttlShRegistry{buildID: buildID}
+	case strings.Contains(name, ".dkr.ecr.") && strings.Contains(name, ".amazonaws.com"):
+		return &ecrRegistry{repo: name, tagTemplate: tagTemplate, buildID: buildID, gitSHA: gitSHA}
+	case !looksLikeRegistryHost(strings.SplitN(name, "/", 2)[0]):
+		// No host-like first path segment means it's a Docker Hub
+		// namespace (docker.io is the implicit default registry host).
+		repo := name
+		if !strings.HasPrefix(repo, "docker.io/") {
+			repo = "docker.io/" + repo
+		}
+		return &credentialRegistry{host: "docker.io", repo: repo, tagTemplate: tagTemplate, buildID: buildID, gitSHA: gitSHA}
+	default:
+		host := strings.SplitN(name, "/", 2)[0]
+		return &credentialRegistry{host: host, repo: name, tagTemplate: tagTemplate, buildID: buildID, gitSHA: gitSHA}
+	}
+}
+
+// looksLikeRegistryHost reports whether segment (the first "/"-separated
+// part of a --registry value) looks like a registry host rather than a
+// Docker Hub namespace - i.e. it has a DNS-style dot (ghcr.io), is
+// "localhost", or carries an explicit port (localhost:5000).
+func looksLikeRegistryHost(segment string) bool {
+	return strings.Contains(segment, ".") || strings.Contains(segment, ":") || segment == "localhost"
+}
+
+// tagData is the template context available to --tag-template.
+type tagData struct {
+	Service string
+	BuildID string
+	Git     struct {
+		ShortSHA string
+	}
+}
+
+// renderTag expands tmpl (a text/template string) against data, falling back
+// to "<service>-<buildID>" (the prior hardcoded scheme) if tmpl is empty or
+// fails to parse/execute.
+func renderTag(tmpl, service, buildID, gitSHA string) string {
+	fallback := fmt.Sprintf("%s-%s", service, buildID)
+	if tmpl == "" {
+		return fallback
+	}
+
+	t, err := template.New("tag").Parse(tmpl)
+	if err != nil {
+		log.Printf("⚠️  Invalid --tag-template %q: %v, using %q", tmpl, err, fallback)
+		return fallback
+	}
+
+	data := tagData{Service: service, BuildID: buildID}
+	data.Git.ShortSHA = gitSHA
+
+	var buf strings.Builder
+	if err := t.Execute(&buf, data); err != nil {
+		log.Printf("⚠️  Could not render --tag-template %q: %v, using %q", tmpl, err, fallback)
+		return fallback
+	}
+	return buf.String()
+}
+
+// gitShortSHA returns the short commit SHA of repoPath's HEAD, or "" if it
+// isn't a git repository (or git isn't installed) - this is best-effort
+// metadata for tag templates, not something a build should fail over.
+func gitShortSHA(repoPath string) string {
+	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// ttlShRegistry is the original default: anonymous, ephemeral 1h images.
+type ttlShRegistry struct {
+	buildID string
+}
+
+func (r *ttlShRegistry) ImageRef(service string) string {
+	return fmt.Sprintf("ttl.sh/%s-%s:1h", service, r.buildID)
+}
+
+func (r *ttlShRegistry) Authenticate(ctx context.Context, client *dagger.Client, container *dagger.Container) (*dagger.Container, error) {
+	return container, nil
+}
+
+// credentialRegistry covers Docker Hub, GHCR, and any other registry that
+// authenticates with a plain username/password (or PAT-as-password),
+// resolved via resolveRegistryCredentials.
+type credentialRegistry struct {
+	host        string
+	repo        string // e.g. "ghcr.io/myorg" or "docker.io/myuser"
+	tagTemplate string
+	buildID     string
+	gitSHA      string
+}
+
+func (r *credentialRegistry) ImageRef(service string) string {
+	return fmt.Sprintf("%s/%s:%s", r.repo, service, renderTag(r.tagTemplate, service, r.buildID, r.gitSHA))
+}
+
+func (r *credentialRegistry) Authenticate(ctx context.Context, client *dagger.Client, container *dagger.Container) (*dagger.Container, error) {
+	username, password, err := resolveRegistryCredentials(r.host)
+	if err != nil {
+		return container, fmt.Errorf("no credentials for %s: %w", r.host, err)
+	}
+	secret := client.SetSecret(strings.NewReplacer(".", "-").Replace(r.host)+"-password", password)
+	return container.WithRegistryAuth(r.host, username, secret), nil
+}
+
+// ecrRegistry publishes to AWS Elastic Container Registry. It authenticates
+// via `aws ecr get-login-password`, reusing whatever credential chain the
+// AWS CLI already resolves (env vars, profile, instance role) instead of
+// re-implementing STS signing here.
+type ecrRegistry struct {
+	repo        string // full "<account>.dkr.ecr.<region>.amazonaws.com/<repository>"
+	tagTemplate string
+	buildID     string
+	gitSHA      string
+}
+
+func (r *ecrRegistry) ImageRef(service string) string {
+	return fmt.Sprintf("%s/%s:%s", r.repo, service, renderTag(r.tagTemplate, service, r.buildID, r.gitSHA))
+}
+
+func (r *ecrRegistry) Authenticate(ctx context.Context, client *dagger.Client, container *dagger.Container) (*dagger.Container, error) {
+	host := strings.SplitN(r.repo, "/", 2)[0]
+	region := ecrRegionFromHost(host)
+
+	out, err := exec.CommandContext(ctx, "aws", "ecr", "get-login-password", "--region", region).Output()
+	if err != nil {
+		return container, fmt.Errorf("aws ecr get-login-password failed (is the AWS CLI configured?): %w", err)
+	}
+
+	secret := client.SetSecret("ecr-password", strings.TrimSpace(string(out)))
+	return container.WithRegistryAuth(host, "AWS", secret), nil
+}
+
+// ecrRegionFromHost extracts <region> out of
+// "<account>.dkr.ecr.<region>.amazonaws.com".
+func ecrRegionFromHost(host string) string {
+	parts := strings.Split(host, ".")
+	for i, part := range parts {
+		if part == "ecr" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return "us-east-1"
+}
+
+// dockerConfig is the subset of ~/.docker/config.json this runner reads.
+type dockerConfig struct {
+	Auths       map[string]struct{ Auth string } `json:"auths"`
+	CredsStore  string                           `json:"credsStore"`
+	CredHelpers map[string]string                `json:"credHelpers"`
+}
+
+// dockerHubConfigKey is how `docker login`/~/.docker/config.json/credential
+// helpers key Docker Hub entries - not "docker.io", the hostname Dagger's
+// WithRegistryAuth and image references use.
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// resolveRegistryCredentials finds a username/password for host, checking
+// (in order) a registry-specific env var pair, a generic env var pair,
+// ~/.docker/config.json's inline "auth", and finally a docker-credential-
+// <store> helper binary - the same places `docker login` itself persists
+// credentials to.
+func resolveRegistryCredentials(host string) (username, password string, err error) {
+	envPrefix := strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(host))
+	if u, p := os.Getenv(envPrefix+"_USERNAME"), os.Getenv(envPrefix+"_PASSWORD"); u != "" && p != "" {
+		return u, p, nil
+	}
+	if u, p := os.Getenv("REGISTRY_USERNAME"), os.Getenv("REGISTRY_PASSWORD"); u != "" && p != "" {
+		return u, p, nil
+	}
+
+	cfg, err := readDockerConfig()
+	if err != nil {
+		return "", "", fmt.Errorf("no env credentials for %s and could not read docker config: %w", host, err)
+	}
+
+	// ~/.docker/config.json and credential helpers key Docker Hub under the
+	// legacy index hostname, not "docker.io".
+	configKey := host
+	if host == "docker.io" {
+		configKey = dockerHubConfigKey
+	}
+
+	if auth, ok := cfg.Auths[configKey]; ok && auth.Auth != "" {
+		if decoded, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil {
+			if u, p, found := strings.Cut(string(decoded), ":"); found {
+				return u, p, nil
+			}
+		}
+	}
+
+	store := cfg.CredsStore
+	if helper, ok := cfg.CredHelpers[configKey]; ok {
+		store = helper
+	}
+	if store != "" {
+		return runCredentialHelper(store, configKey)
+	}
+
+	return "", "", fmt.Errorf("no credentials found for %s", host)
+}
+
+func readDockerConfig() (*dockerConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// runCredentialHelper shells out to docker-credential-<store> get, the same
+// protocol `docker login`/`docker push` use to fetch stored credentials.
+func runCredentialHelper(store, host string) (username, password string, err error) {
+	cmd := exec.Command("docker-credential-"+store, "get")
+	cmd.Stdin = strings.NewReader(host)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("docker-credential-%s get failed: %w", store, err)
+	}
+
+	var resp struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", "", fmt.Errorf("malformed docker-credential-%s output: %w", store, err)
+	}
+	return resp.Username, resp.Secret, nil
+}
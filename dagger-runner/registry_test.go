@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewRegistry(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry string
+		check    func(t *testing.T, r Registry)
+	}{
+		{
+			name:     "empty defaults to ttl.sh",
+			registry: "",
+			check: func(t *testing.T, r Registry) {
+				if _, ok := r.(*ttlShRegistry); !ok {
+					t.Fatalf("got %T, want *ttlShRegistry", r)
+				}
+			},
+		},
+		{
+			name:     "explicit ttl.sh",
+			registry: "ttl.sh",
+			check: func(t *testing.T, r Registry) {
+				if _, ok := r.(*ttlShRegistry); !ok {
+					t.Fatalf("got %T, want *ttlShRegistry", r)
+				}
+			},
+		},
+		{
+			name:     "bare namespace is Docker Hub",
+			registry: "myuser",
+			check: func(t *testing.T, r Registry) {
+				cr, ok := r.(*credentialRegistry)
+				if !ok {
+					t.Fatalf("got %T, want *credentialRegistry", r)
+				}
+				if cr.host != "docker.io" {
+					t.Errorf("host = %q, want %q", cr.host, "docker.io")
+				}
+				if cr.repo != "docker.io/myuser" {
+					t.Errorf("repo = %q, want %q", cr.repo, "docker.io/myuser")
+				}
+			},
+		},
+		{
+			name:     "docker.io prefixed namespace isn't double-prefixed",
+			registry: "docker.io/myuser",
+			check: func(t *testing.T, r Registry) {
+				cr, ok := r.(*credentialRegistry)
+				if !ok {
+					t.Fatalf("got %T, want *credentialRegistry", r)
+				}
+				if cr.host != "docker.io" {
+					t.Errorf("host = %q, want %q", cr.host, "docker.io")
+				}
+				if cr.repo != "docker.io/myuser" {
+					t.Errorf("repo = %q, want %q", cr.repo, "docker.io/myuser")
+				}
+			},
+		},
+		{
+			name:     "dotted host is a generic/GHCR registry",
+			registry: "ghcr.io/myorg",
+			check: func(t *testing.T, r Registry) {
+				cr, ok := r.(*credentialRegistry)
+				if !ok {
+					t.Fatalf("got %T, want *credentialRegistry", r)
+				}
+				if cr.host != "ghcr.io" {
+					t.Errorf("host = %q, want %q", cr.host, "ghcr.io")
+				}
+				if cr.repo != "ghcr.io/myorg" {
+					t.Errorf("repo = %q, want %q", cr.repo, "ghcr.io/myorg")
+				}
+			},
+		},
+		{
+			name:     "localhost:port is a registry host, not a Docker Hub namespace",
+			registry: "localhost:5000/myapp",
+			check: func(t *testing.T, r Registry) {
+				cr, ok := r.(*credentialRegistry)
+				if !ok {
+					t.Fatalf("got %T, want *credentialRegistry", r)
+				}
+				if cr.host != "localhost:5000" {
+					t.Errorf("host = %q, want %q", cr.host, "localhost:5000")
+				}
+			},
+		},
+		{
+			name:     "bare localhost is a registry host",
+			registry: "localhost/myapp",
+			check: func(t *testing.T, r Registry) {
+				cr, ok := r.(*credentialRegistry)
+				if !ok {
+					t.Fatalf("got %T, want *credentialRegistry", r)
+				}
+				if cr.host != "localhost" {
+					t.Errorf("host = %q, want %q", cr.host, "localhost")
+				}
+			},
+		},
+		{
+			name:     "ECR host",
+			registry: "123456789012.dkr.ecr.us-west-2.amazonaws.com/myrepo",
+			check: func(t *testing.T, r Registry) {
+				er, ok := r.(*ecrRegistry)
+				if !ok {
+					t.Fatalf("got %T, want *ecrRegistry", r)
+				}
+				if er.repo != "123456789012.dkr.ecr.us-west-2.amazonaws.com/myrepo" {
+					t.Errorf("repo = %q, want the full registry name", er.repo)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRegistry(tt.registry, "", "build123", "abc1234")
+			tt.check(t, r)
+		})
+	}
+}
+
+func TestRenderTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		service string
+		buildID string
+		gitSHA  string
+		want    string
+	}{
+		{
+			name:    "empty template falls back to service-buildID",
+			tmpl:    "",
+			service: "client",
+			buildID: "build123",
+			want:    "client-build123",
+		},
+		{
+			name:    "invalid syntax falls back",
+			tmpl:    "{{.Service",
+			service: "client",
+			buildID: "build123",
+			want:    "client-build123",
+		},
+		{
+			name:    "unknown field falls back",
+			tmpl:    "{{.NotAField}}",
+			service: "client",
+			buildID: "build123",
+			want:    "client-build123",
+		},
+		{
+			name:    "renders Service, BuildID, and Git.ShortSHA",
+			tmpl:    "{{.Service}}-{{.BuildID}}-{{.Git.ShortSHA}}",
+			service: "server",
+			buildID: "build456",
+			gitSHA:  "deadbee",
+			want:    "server-build456-deadbee",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderTag(tt.tmpl, tt.service, tt.buildID, tt.gitSHA)
+			if got != tt.want {
+				t.Errorf("renderTag(%q, ...) = %q, want %q", tt.tmpl, got, tt.want)
+			}
+		})
+	}
+}
+
+// withDockerConfig points $HOME at a fresh temp dir containing the given
+// ~/.docker/config.json body, cleaned up automatically at test end.
+func withDockerConfig(t *testing.T, configJSON string) {
+	t.Helper()
+	home := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(home, ".docker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".docker", "config.json"), []byte(configJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+}
+
+// clearRegistryEnvCreds blanks every env var resolveRegistryCredentials
+// checks before falling through to ~/.docker/config.json, so tests only
+// exercise the config-file path regardless of the ambient environment.
+func clearRegistryEnvCreds(t *testing.T, host string) {
+	t.Helper()
+	envPrefix := strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(host))
+	t.Setenv(envPrefix+"_USERNAME", "")
+	t.Setenv(envPrefix+"_PASSWORD", "")
+	t.Setenv("REGISTRY_USERNAME", "")
+	t.Setenv("REGISTRY_PASSWORD", "")
+}
+
+func basicAuth(user, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
+
+func TestResolveRegistryCredentialsDockerHubConfigKey(t *testing.T) {
+	clearRegistryEnvCreds(t, "docker.io")
+	withDockerConfig(t, `{"auths": {"https://index.docker.io/v1/": {"auth": "`+basicAuth("huser", "hpass")+`"}}}`)
+
+	user, pass, err := resolveRegistryCredentials("docker.io")
+	if err != nil {
+		t.Fatalf("resolveRegistryCredentials: %v", err)
+	}
+	if user != "huser" || pass != "hpass" {
+		t.Errorf("got (%q, %q), want (%q, %q)", user, pass, "huser", "hpass")
+	}
+}
+
+func TestResolveRegistryCredentialsDockerHubLiteralKeyMisses(t *testing.T) {
+	clearRegistryEnvCreds(t, "docker.io")
+	// Keyed under "docker.io" instead of the legacy index hostname - this is
+	// NOT what `docker login` writes, so it should not be found.
+	withDockerConfig(t, `{"auths": {"docker.io": {"auth": "`+basicAuth("huser", "hpass")+`"}}}`)
+
+	if _, _, err := resolveRegistryCredentials("docker.io"); err == nil {
+		t.Fatal("resolveRegistryCredentials succeeded using the wrong config key, want an error")
+	}
+}
+
+func TestResolveRegistryCredentialsGenericHostUsesItsOwnHost(t *testing.T) {
+	clearRegistryEnvCreds(t, "ghcr.io")
+	withDockerConfig(t, `{"auths": {"ghcr.io": {"auth": "`+basicAuth("guser", "gpass")+`"}}}`)
+
+	user, pass, err := resolveRegistryCredentials("ghcr.io")
+	if err != nil {
+		t.Fatalf("resolveRegistryCredentials: %v", err)
+	}
+	if user != "guser" || pass != "gpass" {
+		t.Errorf("got (%q, %q), want (%q, %q)", user, pass, "guser", "gpass")
+	}
+}